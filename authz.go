@@ -0,0 +1,136 @@
+package keystone
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Identity is the authenticated request context this middleware attaches to
+// a request, for handlers that want typed access instead of parsing
+// X-Roles/X-Project-Id/X-Domain-Id themselves.
+type Identity struct {
+	UserID    string
+	ProjectID string
+	DomainID  string
+	Roles     []string
+}
+
+// HasRole reports whether the identity carries role.
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFromRequest extracts the Identity this middleware attached to req.
+// It returns false if the request was not authenticated, i.e.
+// X-Identity-Status is not "Confirmed".
+func IdentityFromRequest(req *http.Request) (*Identity, bool) {
+	if req.Header.Get("X-Identity-Status") != "Confirmed" {
+		return nil, false
+	}
+	identity := &Identity{
+		UserID:    req.Header.Get("X-User-Id"),
+		ProjectID: req.Header.Get("X-Project-Id"),
+		DomainID:  req.Header.Get("X-Domain-Id"),
+	}
+	if roles := req.Header.Get("X-Roles"); roles != "" {
+		identity.Roles = strings.Split(roles, ",")
+	}
+	return identity, true
+}
+
+// Scope names the OpenStack authorization scope a policy rule is evaluated
+// against. System scope isn't represented: this middleware doesn't set a
+// header for it, and an unscoped token (ProjectID and DomainID both empty)
+// is not the same thing as a system-scoped one.
+type Scope int
+
+const (
+	ProjectScope Scope = iota
+	DomainScope
+)
+
+// Rule is a composable policy predicate evaluated against an Identity,
+// mirroring OpenStack's policy.json rule language.
+type Rule func(*Identity) bool
+
+// RoleIs builds a Rule matching an identity carrying role.
+func RoleIs(role string) Rule {
+	return func(i *Identity) bool { return i.HasRole(role) }
+}
+
+// ProjectIs builds a Rule matching an identity scoped to projectID.
+func ProjectIs(projectID string) Rule {
+	return func(i *Identity) bool { return i.ProjectID == projectID }
+}
+
+// DomainIs builds a Rule matching an identity scoped to domainID.
+func DomainIs(domainID string) Rule {
+	return func(i *Identity) bool { return i.DomainID == domainID }
+}
+
+// Any is satisfied if any rule in rules is.
+func Any(rules ...Rule) Rule {
+	return func(i *Identity) bool {
+		for _, rule := range rules {
+			if rule(i) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All is satisfied only if every rule in rules is.
+func All(rules ...Rule) Rule {
+	return func(i *Identity) bool {
+		for _, rule := range rules {
+			if !rule(i) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RequirePolicy wraps next, responding 403 Forbidden to requests that are
+// not authenticated or whose Identity does not satisfy rule.
+func RequirePolicy(next http.Handler, rule Rule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := IdentityFromRequest(req)
+		if !ok || !rule(identity) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// RequireRoles wraps next, responding 403 Forbidden unless the authenticated
+// identity carries at least one of roles.
+func RequireRoles(next http.Handler, roles ...string) http.Handler {
+	rules := make([]Rule, len(roles))
+	for i, role := range roles {
+		rules[i] = RoleIs(role)
+	}
+	return RequirePolicy(next, Any(rules...))
+}
+
+// RequireScope wraps next, responding 403 Forbidden unless the authenticated
+// identity is scoped as scope requires.
+func RequireScope(next http.Handler, scope Scope) http.Handler {
+	return RequirePolicy(next, func(i *Identity) bool {
+		switch scope {
+		case ProjectScope:
+			return i.ProjectID != ""
+		case DomainScope:
+			return i.DomainID != ""
+		default:
+			return false
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package keystone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestIdentityFromRequestRejectsUnauthenticated(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if _, ok := IdentityFromRequest(req); ok {
+		t.Fatal("IdentityFromRequest succeeded without X-Identity-Status: Confirmed, want false")
+	}
+}
+
+func TestIdentityFromRequestParsesConfirmedIdentity(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Identity-Status", "Confirmed")
+	req.Header.Set("X-User-Id", "user-1")
+	req.Header.Set("X-Project-Id", "project-1")
+	req.Header.Set("X-Roles", "admin,member")
+
+	identity, ok := IdentityFromRequest(req)
+	if !ok {
+		t.Fatal("IdentityFromRequest failed for a Confirmed request, want true")
+	}
+	if identity.UserID != "user-1" || identity.ProjectID != "project-1" {
+		t.Errorf("identity = %+v, want UserID=user-1 ProjectID=project-1", identity)
+	}
+	if !identity.HasRole("admin") || !identity.HasRole("member") {
+		t.Errorf("identity.Roles = %v, want admin and member", identity.Roles)
+	}
+}
+
+func TestRequireRoles(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		roles      string
+		wantStatus int
+	}{
+		{
+			name:       "unauthenticated request is rejected",
+			status:     "",
+			roles:      "",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "authenticated without the required role is rejected",
+			status:     "Confirmed",
+			roles:      "member",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "authenticated with the required role passes",
+			status:     "Confirmed",
+			roles:      "member,admin",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.status != "" {
+				req.Header.Set("X-Identity-Status", tt.status)
+			}
+			if tt.roles != "" {
+				req.Header.Set("X-Roles", tt.roles)
+			}
+
+			rec := httptest.NewRecorder()
+			RequireRoles(okHandler(), "admin").ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireScopeProjectRejectsEmptyProjectID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Identity-Status", "Confirmed")
+
+	rec := httptest.NewRecorder()
+	RequireScope(okHandler(), ProjectScope).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d for an empty X-Project-Id", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestRequireScopeProjectAllowsPopulatedProjectID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Identity-Status", "Confirmed")
+	req.Header.Set("X-Project-Id", "project-1")
+
+	rec := httptest.NewRecorder()
+	RequireScope(okHandler(), ProjectScope).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d for a populated X-Project-Id", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,183 @@
+package keystone
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WithCacheSkew subtracts skew from a token's `expires_at` when computing how
+// long to cache it, so a token doesn't validate from cache right up to the
+// moment Keystone itself considers it expired.
+func WithCacheSkew(skew time.Duration) Option {
+	return func(h *authHandler) {
+		h.cacheSkew = skew
+	}
+}
+
+// WithMaxCacheTTL caps how long any token, however long-lived, is kept in the
+// cache. The default is 5 minutes, matching the middleware's original
+// hard-coded TTL.
+func WithMaxCacheTTL(ttl time.Duration) Option {
+	return func(h *authHandler) {
+		h.maxCacheTTL = ttl
+	}
+}
+
+// WithNegativeCacheTTL enables negative caching: a token Keystone rejects
+// with 401 or 404 is remembered as invalid for ttl, so a flood of requests
+// carrying the same bad token doesn't hammer the identity endpoint. Disabled
+// (ttl <= 0) by default.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(h *authHandler) {
+		h.negativeCacheTTL = ttl
+	}
+}
+
+// EvictableCache is a Cache extension that additionally supports deleting and
+// iterating entries. It is only required when running a RevocationPoller
+// against the same cache passed to Handler.
+type EvictableCache interface {
+	Cache
+	Delete(k string)
+	Range(f func(k string, v interface{}) bool)
+}
+
+type revocationEvent struct {
+	AuditID   string `json:"audit_id"`
+	UserID    string `json:"user_id"`
+	ProjectID string `json:"project_id"`
+}
+
+type revocationEventsResponse struct {
+	Events []revocationEvent `json:"events"`
+}
+
+// RevocationPoller periodically polls Keystone's revocation events endpoint
+// (`/v3/OS-REVOKE/events`) and evicts matching entries from an
+// EvictableCache by audit_id, user_id or project_id, so a cached token stops
+// validating as soon as Keystone considers it revoked rather than only once
+// its cache TTL expires.
+type RevocationPoller struct {
+	Endpoint  string
+	Cache     EvictableCache
+	Client    *http.Client
+	Interval  time.Duration
+	UserAgent string
+
+	stop chan struct{}
+}
+
+// Start begins polling in a background goroutine. Call Stop to end it.
+func (p *RevocationPoller) Start() {
+	if p.Client == nil {
+		p.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	if p.Interval <= 0 {
+		p.Interval = time.Minute
+	}
+	if p.UserAgent == "" {
+		p.UserAgent = "go-keystone-middleware/1.0"
+	}
+	p.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.poll()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background polling goroutine started by Start.
+func (p *RevocationPoller) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+}
+
+func (p *RevocationPoller) poll() {
+	req, err := http.NewRequest("GET", p.Endpoint+"/OS-REVOKE/events", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", p.UserAgent)
+
+	r, err := p.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+
+	var resp revocationEventsResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return
+	}
+
+	for _, event := range resp.Events {
+		p.evict(event)
+	}
+}
+
+func (p *RevocationPoller) evict(event revocationEvent) {
+	var matched []string
+	p.Cache.Range(func(k string, v interface{}) bool {
+		if revocationEventMatches(event, v) {
+			matched = append(matched, k)
+		}
+		return true
+	})
+	for _, k := range matched {
+		p.Cache.Delete(k)
+	}
+}
+
+// revocationEventMatches reports whether cached value v is revoked by event.
+// Keystone revocation events are conjunctive: a cached token must match every
+// field the event populates, not merely one of them.
+func revocationEventMatches(event revocationEvent, v interface{}) bool {
+	cached, ok := v.(token)
+	if !ok {
+		return false
+	}
+
+	matchedAny := false
+
+	if event.AuditID != "" {
+		matched := false
+		if cached.AuditIDs != nil {
+			for _, id := range *cached.AuditIDs {
+				if id == event.AuditID {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+		matchedAny = true
+	}
+
+	if event.UserID != "" {
+		if cached.User.ID != event.UserID {
+			return false
+		}
+		matchedAny = true
+	}
+
+	if event.ProjectID != "" {
+		if cached.Project == nil || cached.Project.ID != event.ProjectID {
+			return false
+		}
+		matchedAny = true
+	}
+
+	return matchedAny
+}
@@ -0,0 +1,133 @@
+package keystone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthHandlerCacheTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		h         *authHandler
+		expiresAt string
+		wantZero  bool
+		wantMax   bool
+	}{
+		{
+			name:      "no expires_at uses maxCacheTTL",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute},
+			expiresAt: "",
+			wantMax:   true,
+		},
+		{
+			name:      "unparsable expires_at uses maxCacheTTL",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute},
+			expiresAt: "not-a-timestamp",
+			wantMax:   true,
+		},
+		{
+			name:      "already expired yields zero, not maxCacheTTL",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute},
+			expiresAt: time.Now().Add(-time.Minute).Format(time.RFC3339),
+			wantZero:  true,
+		},
+		{
+			name:      "within cacheSkew of expiring yields zero",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute, cacheSkew: time.Minute},
+			expiresAt: time.Now().Add(30 * time.Second).Format(time.RFC3339),
+			wantZero:  true,
+		},
+		{
+			name:      "far expiry capped at maxCacheTTL",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute},
+			expiresAt: time.Now().Add(time.Hour).Format(time.RFC3339),
+			wantMax:   true,
+		},
+		{
+			name:      "near expiry shorter than maxCacheTTL is used as-is",
+			h:         &authHandler{maxCacheTTL: 5 * time.Minute},
+			expiresAt: time.Now().Add(time.Minute).Format(time.RFC3339),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &token{ExpiresAt: tt.expiresAt}
+			ttl := tt.h.cacheTTL(ctx)
+
+			if ttl < 0 {
+				t.Fatalf("cacheTTL() = %v, want >= 0", ttl)
+			}
+			if tt.wantZero && ttl != 0 {
+				t.Errorf("cacheTTL() = %v, want 0", ttl)
+			}
+			if tt.wantMax && ttl != tt.h.maxCacheTTL {
+				t.Errorf("cacheTTL() = %v, want maxCacheTTL %v", ttl, tt.h.maxCacheTTL)
+			}
+			if !tt.wantZero && !tt.wantMax && ttl >= tt.h.maxCacheTTL {
+				t.Errorf("cacheTTL() = %v, want < maxCacheTTL %v", ttl, tt.h.maxCacheTTL)
+			}
+		})
+	}
+}
+
+func TestRevocationEventMatches(t *testing.T) {
+	auditIDs := []string{"audit-1", "audit-2"}
+	cached := token{
+		AuditIDs: &auditIDs,
+		Project:  &project{ID: "project-1"},
+	}
+	cached.User.ID = "user-1"
+
+	tests := []struct {
+		name  string
+		event revocationEvent
+		v     interface{}
+		want  bool
+	}{
+		{
+			name:  "single field match (user_id)",
+			event: revocationEvent{UserID: "user-1"},
+			v:     cached,
+			want:  true,
+		},
+		{
+			name:  "single field match (audit_id)",
+			event: revocationEvent{AuditID: "audit-2"},
+			v:     cached,
+			want:  true,
+		},
+		{
+			name:  "multi-field event where only one field matches does not evict",
+			event: revocationEvent{UserID: "user-1", ProjectID: "someone-elses-project"},
+			v:     cached,
+			want:  false,
+		},
+		{
+			name:  "multi-field event matching every populated field evicts",
+			event: revocationEvent{UserID: "user-1", ProjectID: "project-1"},
+			v:     cached,
+			want:  true,
+		},
+		{
+			name:  "empty-fields event matches nothing",
+			event: revocationEvent{},
+			v:     cached,
+			want:  false,
+		},
+		{
+			name:  "value that is not a token never matches",
+			event: revocationEvent{UserID: "user-1"},
+			v:     invalidToken{},
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revocationEventMatches(tt.event, tt.v); got != tt.want {
+				t.Errorf("revocationEventMatches(%+v) = %v, want %v", tt.event, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package keystone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Credentials describes how this middleware authenticates itself as a
+// service user against Keystone, modelled after the AuthOpts used by the
+// OpenStack Go clients. Exactly one of Password or ApplicationCredential
+// should be set.
+type Credentials struct {
+	Password              *PasswordCredentials
+	ApplicationCredential *ApplicationCredential
+}
+
+// PasswordCredentials authenticates with a username/password, scoped to a
+// project.
+type PasswordCredentials struct {
+	Username          string
+	Password          string
+	DomainName        string
+	ProjectName       string
+	ProjectDomainName string
+}
+
+// ApplicationCredential authenticates with a Keystone application
+// credential, which is already project-scoped and needs no further scope.
+type ApplicationCredential struct {
+	ID     string
+	Secret string
+}
+
+// requestBody builds the `/v3/auth/tokens` request body for these
+// credentials.
+func (c Credentials) requestBody() ([]byte, error) {
+	switch {
+	case c.ApplicationCredential != nil:
+		ac := c.ApplicationCredential
+		return json.Marshal(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"identity": map[string]interface{}{
+					"methods": []string{"application_credential"},
+					"application_credential": map[string]interface{}{
+						"id":     ac.ID,
+						"secret": ac.Secret,
+					},
+				},
+			},
+		})
+	case c.Password != nil:
+		p := c.Password
+		return json.Marshal(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"identity": map[string]interface{}{
+					"methods": []string{"password"},
+					"password": map[string]interface{}{
+						"user": map[string]interface{}{
+							"name":     p.Username,
+							"password": p.Password,
+							"domain":   map[string]interface{}{"name": p.DomainName},
+						},
+					},
+				},
+				"scope": map[string]interface{}{
+					"project": map[string]interface{}{
+						"name":   p.ProjectName,
+						"domain": map[string]interface{}{"name": p.ProjectDomainName},
+					},
+				},
+			},
+		})
+	default:
+		return nil, errors.New("keystone: Credentials must set Password or ApplicationCredential")
+	}
+}
+
+// serviceTokenRefreshSkew is how far ahead of a service token's expires_at it
+// is proactively refreshed.
+const serviceTokenRefreshSkew = 30 * time.Second
+
+// serviceTokenClient authenticates with Credentials and caches the resulting
+// service token, refreshing it shortly before it expires.
+type serviceTokenClient struct {
+	endpoint  string
+	creds     Credentials
+	client    *http.Client
+	userAgent string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newServiceTokenClient(endpoint string, creds Credentials, client *http.Client, userAgent string) *serviceTokenClient {
+	return &serviceTokenClient{
+		endpoint:  endpoint,
+		creds:     creds,
+		client:    client,
+		userAgent: userAgent,
+	}
+}
+
+// Token returns a valid service token, authenticating or refreshing as
+// needed.
+func (c *serviceTokenClient) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiresAt) > serviceTokenRefreshSkew {
+		return c.token, nil
+	}
+	return c.authenticate()
+}
+
+func (c *serviceTokenClient) authenticate() (string, error) {
+	body, err := c.creds.requestBody()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint+"/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+
+	r, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+
+	var resp authResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return "", err
+	}
+	if e := resp.Error; e != nil {
+		return "", fmt.Errorf("%s : %s", r.Status, e.Message)
+	}
+	if r.StatusCode != http.StatusCreated || resp.Token == nil {
+		return "", fmt.Errorf("keystone: failed to authenticate service credentials: %s", r.Status)
+	}
+
+	subjectToken := r.Header.Get("X-Subject-Token")
+	if subjectToken == "" {
+		return "", errors.New("keystone: auth response did not include X-Subject-Token")
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, resp.Token.ExpiresAt)
+	if err != nil {
+		return "", fmt.Errorf("keystone: failed to parse service token expires_at: %w", err)
+	}
+
+	c.token = subjectToken
+	c.expiresAt = expiresAt
+	return c.token, nil
+}
+
+// HandlerWithCredentials returns a keystone http middleware like Handler, but
+// authenticates itself against Keystone using creds and passes the resulting
+// service token as `X-Auth-Token` on validation requests, sending only the
+// token under review as `X-Subject-Token`. This is the standard OpenStack
+// deployment model, where the token being validated need not have permission
+// to read itself.
+func HandlerWithCredentials(h http.Handler, endpoint string, creds Credentials, cache Cache, opts ...Option) http.Handler {
+	handler := Handler(h, endpoint, cache, opts...).(*authHandler)
+	handler.serviceTokenClient = newServiceTokenClient(endpoint, creds, handler.client, handler.userAgent)
+	return handler
+}
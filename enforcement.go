@@ -0,0 +1,72 @@
+package keystone
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// EnforcementMode controls what the middleware does when a request arrives
+// without a valid `X-Auth-Token`.
+type EnforcementMode int
+
+const (
+	// Delegate (the default) leaves the authentication decision to
+	// subsequent handlers: the request is passed downstream with
+	// `X-Identity-Status: Invalid` and no other change.
+	Delegate EnforcementMode = iota
+	// Required rejects the request with 401 Unauthorized instead of
+	// delegating.
+	Required
+	// RequiredWithChallenge behaves like Required, and additionally sets a
+	// `WWW-Authenticate: Keystone uri="<identityEndpoint>"` challenge header
+	// so clients can discover where to obtain a token.
+	RequiredWithChallenge
+)
+
+// WithEnforcementMode configures how unauthenticated requests are handled.
+// See EnforcementMode.
+func WithEnforcementMode(mode EnforcementMode) Option {
+	return func(h *authHandler) {
+		h.enforcementMode = mode
+	}
+}
+
+// WithExemptPaths exempts the given request paths from enforcement, for
+// example health-check endpoints. A path ending in "*" matches as a prefix;
+// any other path must match exactly.
+func WithExemptPaths(paths []string) Option {
+	return func(h *authHandler) {
+		h.exemptPaths = paths
+	}
+}
+
+// isExempt reports whether path is excluded from enforcement.
+func (h *authHandler) isExempt(path string) bool {
+	for _, exempt := range h.exemptPaths {
+		if strings.HasSuffix(exempt, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(exempt, "*")) {
+				return true
+			}
+			continue
+		}
+		if path == exempt {
+			return true
+		}
+	}
+	return false
+}
+
+// enforce applies the configured EnforcementMode to an unauthenticated
+// request. It returns true if the request was rejected and must not be
+// passed downstream.
+func (h *authHandler) enforce(w http.ResponseWriter, req *http.Request) bool {
+	if h.enforcementMode == Delegate || h.isExempt(req.URL.Path) {
+		return false
+	}
+	if h.enforcementMode == RequiredWithChallenge {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Keystone uri=%q", h.identityEndpoint))
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return true
+}
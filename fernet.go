@@ -0,0 +1,366 @@
+package keystone
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fernetVersion = 0x80
+
+// FernetValidator locally decrypts and validates Keystone Fernet tokens
+// without contacting the identity endpoint. Keys is the ordered list of
+// fernet keys read from /etc/keystone/fernet-keys (index 0 is primary, the
+// rest are secondary keys still accepted for validation); use Rotator
+// instead to have the key list refreshed without a restart.
+//
+// Only the fields Keystone's fernet payload carries directly - user id,
+// project or domain id, expiry and audit ids - are populated on the returned token;
+// role names are not part of the payload and are left unset.
+type FernetValidator struct {
+	Keys          [][]byte
+	MaxAgeSeconds int64
+	Rotator       KeyRotator
+}
+
+func (v *FernetValidator) keys() [][]byte {
+	if v.Rotator != nil {
+		return v.Rotator.Keys()
+	}
+	return v.Keys
+}
+
+// Validate decodes and verifies a Fernet token, returning the token context
+// it carries. It returns an error for anything that isn't a well-formed,
+// correctly signed Fernet token, or one whose own `expires_at` has passed -
+// independently of MaxAgeSeconds, which only bounds how old the Fernet
+// envelope itself may be - so callers can fall back to remote validation.
+func (v *FernetValidator) Validate(tok string) (*token, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil {
+		return nil, fmt.Errorf("keystone: not a fernet token: %w", err)
+	}
+	if len(raw) < 1+8+16+sha256.Size {
+		return nil, errors.New("keystone: fernet token too short")
+	}
+	if raw[0] != fernetVersion {
+		return nil, fmt.Errorf("keystone: unsupported fernet version 0x%x", raw[0])
+	}
+
+	macStart := len(raw) - sha256.Size
+	signed := raw[:macStart]
+	mac := raw[macStart:]
+	timestamp := int64(binary.BigEndian.Uint64(raw[1:9]))
+	iv := raw[9:25]
+	ciphertext := raw[25:macStart]
+
+	if v.MaxAgeSeconds > 0 && time.Now().Unix()-timestamp > v.MaxAgeSeconds {
+		return nil, errors.New("keystone: fernet token expired")
+	}
+
+	keys := v.keys()
+	if len(keys) == 0 {
+		return nil, errors.New("keystone: no fernet keys configured")
+	}
+
+	var lastErr error
+	for _, key := range keys {
+		if len(key) != 32 {
+			lastErr = errors.New("keystone: fernet keys must be 32 bytes")
+			continue
+		}
+		signingKey, encryptionKey := key[:16], key[16:]
+
+		h := hmac.New(sha256.New, signingKey)
+		h.Write(signed)
+		if !hmac.Equal(h.Sum(nil), mac) {
+			lastErr = errors.New("keystone: fernet HMAC mismatch")
+			continue
+		}
+
+		plaintext, err := decryptAESCBC(encryptionKey, iv, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		result, err := fernetPayloadToToken(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if result.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, result.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("keystone: failed to parse fernet token expires_at: %w", err)
+			}
+			if time.Now().After(expiresAt) {
+				return nil, errors.New("keystone: fernet token expired")
+			}
+		}
+		return result, nil
+	}
+	return nil, lastErr
+}
+
+func decryptAESCBC(key, iv, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("keystone: invalid fernet ciphertext length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return pkcs7Unpad(plaintext)
+}
+
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("keystone: empty fernet plaintext")
+	}
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > aes.BlockSize || padLen > len(data) {
+		return nil, errors.New("keystone: invalid fernet padding")
+	}
+	for _, b := range data[len(data)-padLen:] {
+		if int(b) != padLen {
+			return nil, errors.New("keystone: invalid fernet padding")
+		}
+	}
+	return data[:len(data)-padLen], nil
+}
+
+// Keystone's token_formatters.py payload-class versions. Each lays out the
+// msgpack array that follows [version, user_id, methods, ...] differently:
+// UnscopedPayload has no scope id, DomainScopedPayload packs a domain id,
+// ProjectScopedPayload packs a project id. Other versions (trust, federated,
+// oauth1, application credential, ...) aren't handled locally.
+const (
+	fernetPayloadUnscoped      = 0
+	fernetPayloadDomainScoped  = 1
+	fernetPayloadProjectScoped = 2
+)
+
+// fernetPayloadToToken maps the msgpack-decoded fernet payload onto a token.
+// UUIDs are packed as raw 16-byte binaries (re-hex-encoded here back into
+// the id strings Keystone's HTTP API uses) and expires_at is packed as a
+// unix timestamp, not a string. Audit ids are packed the same way as user
+// and scope ids and are re-encoded as base64url to match the audit_id
+// format Keystone returns over the HTTP validation API.
+func fernetPayloadToToken(plaintext []byte) (*token, error) {
+	decoded, _, err := decodeMsgPack(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("keystone: failed to decode fernet payload: %w", err)
+	}
+	fields, ok := decoded.([]interface{})
+	if !ok || len(fields) < 4 {
+		return nil, errors.New("keystone: unrecognized fernet payload shape")
+	}
+
+	version, ok := fernetNumber(fields[0])
+	if !ok {
+		return nil, errors.New("keystone: fernet payload missing version")
+	}
+
+	t := &token{}
+	// fields[2] is the auth methods bitmask (password, token, ...); it
+	// carries no authorization information, so Roles stays unset here.
+	t.User.ID = fernetID(fields[1])
+
+	var expiresAtField, auditIDsField interface{}
+	switch version {
+	case fernetPayloadUnscoped:
+		if len(fields) < 5 {
+			return nil, errors.New("keystone: unrecognized unscoped fernet payload shape")
+		}
+		expiresAtField, auditIDsField = fields[3], fields[4]
+	case fernetPayloadDomainScoped:
+		if len(fields) < 6 {
+			return nil, errors.New("keystone: unrecognized domain-scoped fernet payload shape")
+		}
+		if id := fernetID(fields[3]); id != "" {
+			t.Domain = &domain{ID: id}
+		}
+		expiresAtField, auditIDsField = fields[4], fields[5]
+	case fernetPayloadProjectScoped:
+		if len(fields) < 6 {
+			return nil, errors.New("keystone: unrecognized project-scoped fernet payload shape")
+		}
+		if id := fernetID(fields[3]); id != "" {
+			t.Project = &project{ID: id}
+		}
+		expiresAtField, auditIDsField = fields[4], fields[5]
+	default:
+		return nil, fmt.Errorf("keystone: unsupported fernet payload version %d", version)
+	}
+
+	if expiresAt, ok := fernetNumber(expiresAtField); ok {
+		t.ExpiresAt = time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	if ids, ok := auditIDsField.([]interface{}); ok {
+		auditIDs := make([]string, 0, len(ids))
+		for _, raw := range ids {
+			if b, ok := raw.([]byte); ok {
+				auditIDs = append(auditIDs, base64.RawURLEncoding.EncodeToString(b))
+			}
+		}
+		t.AuditIDs = &auditIDs
+	}
+
+	return t, nil
+}
+
+func fernetID(v interface{}) string {
+	switch val := v.(type) {
+	case []byte:
+		return hex.EncodeToString(val)
+	case string:
+		return val
+	default:
+		return ""
+	}
+}
+
+// fernetNumber converts a msgpack-decoded integer or float - Keystone packs
+// both the payload version and expires_at this way - to an int64.
+func fernetNumber(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return val, true
+	case float64:
+		return int64(val), true
+	default:
+		return 0, false
+	}
+}
+
+// KeyRotator supplies the current ordered list of Fernet keys to a
+// FernetValidator so rotated keys are picked up without restarting the
+// process.
+type KeyRotator interface {
+	Keys() [][]byte
+}
+
+// FileKeyRotator is the default KeyRotator: it watches a directory of
+// urlsafe-base64-encoded fernet key files named by index, as written by
+// `keystone-manage fernet_setup`/`fernet_rotate` ("0" is primary), reloading
+// them on a poll interval.
+type FileKeyRotator struct {
+	Dir          string
+	PollInterval time.Duration
+
+	mu   sync.RWMutex
+	keys [][]byte
+	stop chan struct{}
+}
+
+// NewFileKeyRotator creates a FileKeyRotator and performs an initial load of
+// dir's key files.
+func NewFileKeyRotator(dir string) (*FileKeyRotator, error) {
+	r := &FileKeyRotator{Dir: dir, PollInterval: 30 * time.Second}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Keys returns the most recently loaded key list, ordered with the primary
+// key (index 0) first.
+func (r *FileKeyRotator) Keys() [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys
+}
+
+// Start begins polling Dir for key changes in a background goroutine. Call
+// Stop to end it.
+func (r *FileKeyRotator) Start() {
+	if r.PollInterval <= 0 {
+		r.PollInterval = 30 * time.Second
+	}
+	r.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(r.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = r.reload()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background polling goroutine started by Start.
+func (r *FileKeyRotator) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
+
+func (r *FileKeyRotator) reload() error {
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	type indexedKey struct {
+		index int
+		key   []byte
+	}
+	var indexed []indexedKey
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(r.Dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		key, err := base64.URLEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("keystone: invalid fernet key file %q: %w", entry.Name(), err)
+		}
+		indexed = append(indexed, indexedKey{index, key})
+	}
+	sort.Slice(indexed, func(i, j int) bool { return indexed[i].index < indexed[j].index })
+
+	keys := make([][]byte, len(indexed))
+	for i, ik := range indexed {
+		keys[i] = ik.key
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return nil
+}
+
+// HandlerWithLocalValidator returns a keystone http middleware like Handler,
+// but tries to validate tokens locally via validator before falling back to
+// an HTTP call to endpoint. This avoids a Keystone round-trip for every
+// request when tokens are in Fernet format.
+func HandlerWithLocalValidator(h http.Handler, endpoint string, cache Cache, validator *FernetValidator, opts ...Option) http.Handler {
+	handler := Handler(h, endpoint, cache, opts...).(*authHandler)
+	handler.localValidator = validator
+	return handler
+}
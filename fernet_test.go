@@ -0,0 +1,253 @@
+package keystone
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+// The helpers below hand-encode the handful of MessagePack types Keystone's
+// fernet payload uses, so tests can build a realistic token without a
+// MessagePack dependency.
+
+func packTestArray(items ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x90 | byte(len(items)))
+	for _, item := range items {
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+func packTestBin(b []byte) []byte {
+	return append([]byte{0xc4, byte(len(b))}, b...)
+}
+
+func packTestInt(v int64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = 0xd3
+	binary.BigEndian.PutUint64(buf[1:], uint64(v))
+	return buf
+}
+
+func packTestFloat(v float64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = 0xcb
+	binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+	return buf
+}
+
+// buildFernetToken assembles a Fernet token the same way Keystone's
+// TokenFormatter does for a given payload-class version: a msgpack array of
+// [version, user_id, methods, expires_at, audit_ids] for an unscoped token
+// (fernetPayloadUnscoped), or [version, user_id, methods, scope_id,
+// expires_at, audit_ids] for a domain- or project-scoped one, AES-128-CBC
+// encrypted and HMAC-SHA256 signed per the Fernet spec. scopeIDHex is
+// ignored for an unscoped token.
+func buildFernetToken(t *testing.T, key []byte, version int, userIDHex, scopeIDHex string, expiresAt, issuedAt time.Time) string {
+	t.Helper()
+
+	userID, err := hex.DecodeString(userIDHex)
+	if err != nil {
+		t.Fatalf("invalid userIDHex: %v", err)
+	}
+	auditID := bytes.Repeat([]byte{0x42}, 16)
+
+	var payload []byte
+	if version == fernetPayloadUnscoped {
+		payload = packTestArray(
+			packTestInt(int64(version)),
+			packTestBin(userID),
+			packTestInt(1), // auth methods bitmask
+			packTestFloat(float64(expiresAt.Unix())),
+			packTestArray(packTestBin(auditID)),
+		)
+	} else {
+		scopeID, err := hex.DecodeString(scopeIDHex)
+		if err != nil {
+			t.Fatalf("invalid scopeIDHex: %v", err)
+		}
+		payload = packTestArray(
+			packTestInt(int64(version)),
+			packTestBin(userID),
+			packTestInt(1), // auth methods bitmask
+			packTestBin(scopeID),
+			packTestFloat(float64(expiresAt.Unix())),
+			packTestArray(packTestBin(auditID)),
+		)
+	}
+
+	signingKey, encryptionKey := key[:16], key[16:]
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+
+	padLen := aes.BlockSize - len(payload)%aes.BlockSize
+	padded := append(append([]byte{}, payload...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	signed := []byte{fernetVersion}
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(issuedAt.Unix()))
+	signed = append(signed, ts...)
+	signed = append(signed, iv...)
+	signed = append(signed, ciphertext...)
+
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(signed)
+	signed = append(signed, mac.Sum(nil)...)
+
+	return base64.RawURLEncoding.EncodeToString(signed)
+}
+
+func testFernetKey() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestFernetValidatorValidateDecodesPayload(t *testing.T) {
+	key := testFernetKey()
+	userID := "deadbeefdeadbeefdeadbeefdeadbeef"
+	projectID := "cafebabecafebabecafebabecafebabe"
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	tok := buildFernetToken(t, key, fernetPayloadProjectScoped, userID, projectID, expiresAt, time.Now())
+
+	v := &FernetValidator{Keys: [][]byte{key}}
+	context, err := v.Validate(tok)
+	if err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if context.User.ID != userID {
+		t.Errorf("User.ID = %q, want %q", context.User.ID, userID)
+	}
+	if context.Project == nil || context.Project.ID != projectID {
+		t.Errorf("Project = %+v, want ID %q", context.Project, projectID)
+	}
+	if context.Domain != nil {
+		t.Errorf("Domain = %+v, want nil for a project-scoped token", context.Domain)
+	}
+
+	gotExpiresAt, err := time.Parse(time.RFC3339, context.ExpiresAt)
+	if err != nil {
+		t.Fatalf("ExpiresAt %q did not parse as RFC3339: %v", context.ExpiresAt, err)
+	}
+	if !gotExpiresAt.Equal(expiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", gotExpiresAt, expiresAt)
+	}
+}
+
+func TestFernetValidatorValidateRejectsExpiredToken(t *testing.T) {
+	key := testFernetKey()
+	expiresAt := time.Now().Add(-time.Hour)
+	issuedAt := time.Now().Add(-2 * time.Hour)
+
+	tok := buildFernetToken(t, key, fernetPayloadProjectScoped, "deadbeefdeadbeefdeadbeefdeadbeef", "cafebabecafebabecafebabecafebabe", expiresAt, issuedAt)
+
+	v := &FernetValidator{Keys: [][]byte{key}}
+	if _, err := v.Validate(tok); err == nil {
+		t.Fatal("Validate succeeded for an expired fernet token, want error")
+	}
+}
+
+func TestFernetValidatorValidateRejectsBadSignature(t *testing.T) {
+	key := testFernetKey()
+	otherKey := make([]byte, 32)
+	copy(otherKey, key)
+	otherKey[0] ^= 0xff
+
+	tok := buildFernetToken(t, key, fernetPayloadProjectScoped, "deadbeefdeadbeefdeadbeefdeadbeef", "cafebabecafebabecafebabecafebabe", time.Now().Add(time.Hour), time.Now())
+
+	v := &FernetValidator{Keys: [][]byte{otherKey}}
+	if _, err := v.Validate(tok); err == nil {
+		t.Fatal("Validate succeeded with the wrong key, want error")
+	}
+}
+
+func TestFernetValidatorValidateDomainScopedPayload(t *testing.T) {
+	key := testFernetKey()
+	userID := "deadbeefdeadbeefdeadbeefdeadbeef"
+	domainID := "abad1deaabad1deaabad1deaabad1dea"
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	tok := buildFernetToken(t, key, fernetPayloadDomainScoped, userID, domainID, expiresAt, time.Now())
+
+	v := &FernetValidator{Keys: [][]byte{key}}
+	context, err := v.Validate(tok)
+	if err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if context.Project != nil {
+		t.Errorf("Project = %+v, want nil for a domain-scoped token", context.Project)
+	}
+	if context.Domain == nil || context.Domain.ID != domainID {
+		t.Errorf("Domain = %+v, want ID %q", context.Domain, domainID)
+	}
+
+	gotExpiresAt, err := time.Parse(time.RFC3339, context.ExpiresAt)
+	if err != nil {
+		t.Fatalf("ExpiresAt %q did not parse as RFC3339: %v", context.ExpiresAt, err)
+	}
+	if !gotExpiresAt.Equal(expiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", gotExpiresAt, expiresAt)
+	}
+}
+
+func TestFernetValidatorValidateUnscopedPayload(t *testing.T) {
+	key := testFernetKey()
+	userID := "deadbeefdeadbeefdeadbeefdeadbeef"
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	tok := buildFernetToken(t, key, fernetPayloadUnscoped, userID, "", expiresAt, time.Now())
+
+	v := &FernetValidator{Keys: [][]byte{key}}
+	context, err := v.Validate(tok)
+	if err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if context.Project != nil {
+		t.Errorf("Project = %+v, want nil for an unscoped token", context.Project)
+	}
+	if context.Domain != nil {
+		t.Errorf("Domain = %+v, want nil for an unscoped token", context.Domain)
+	}
+
+	gotExpiresAt, err := time.Parse(time.RFC3339, context.ExpiresAt)
+	if err != nil {
+		t.Fatalf("ExpiresAt %q did not parse as RFC3339: %v", context.ExpiresAt, err)
+	}
+	if !gotExpiresAt.Equal(expiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", gotExpiresAt, expiresAt)
+	}
+}
+
+func TestFernetValidatorValidateUnscopedRejectsExpiredToken(t *testing.T) {
+	key := testFernetKey()
+	expiresAt := time.Now().Add(-time.Hour)
+
+	tok := buildFernetToken(t, key, fernetPayloadUnscoped, "deadbeefdeadbeefdeadbeefdeadbeef", "", expiresAt, time.Now().Add(-2*time.Hour))
+
+	v := &FernetValidator{Keys: [][]byte{key}}
+	if _, err := v.Validate(tok); err == nil {
+		t.Fatal("Validate succeeded for an expired unscoped fernet token, want error")
+	}
+}
@@ -0,0 +1,42 @@
+package keystone
+
+// Logger is the structured logging interface used by this middleware. It
+// mirrors the common leveled, key/value shape shared by logrus, zap and slog
+// so any of them can be wired in behind a thin adapter.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// noopLogger is the default Logger used when none is configured; it discards
+// everything so existing callers see no behavior change.
+type noopLogger struct{}
+
+func (noopLogger) Debug(msg string, kv ...interface{}) {}
+func (noopLogger) Info(msg string, kv ...interface{})  {}
+func (noopLogger) Warn(msg string, kv ...interface{})  {}
+func (noopLogger) Error(msg string, kv ...interface{}) {}
+
+// Option configures optional Handler behavior.
+type Option func(*authHandler)
+
+// WithLogger wires a structured Logger into the middleware. Cache misses,
+// validation failures and decode errors are logged through it with
+// token_id_hash, endpoint, http_status and duration_ms fields.
+func WithLogger(l Logger) Option {
+	return func(h *authHandler) {
+		if l != nil {
+			h.logger = l
+		}
+	}
+}
+
+// WithServiceRoles configures the roles required on a validated
+// X-Service-Token for it to be considered valid. See HandlerWithServiceRoles.
+func WithServiceRoles(roles []string) Option {
+	return func(h *authHandler) {
+		h.serviceRoles = roles
+	}
+}
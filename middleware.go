@@ -9,6 +9,8 @@
 package keystone
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,13 +20,29 @@ import (
 )
 
 type authHandler struct {
-	identityEndpoint string
-	handler          http.Handler
-	client           *http.Client
-	userAgent        string
-	tokenCache       Cache
+	identityEndpoint   string
+	handler            http.Handler
+	client             *http.Client
+	userAgent          string
+	tokenCache         Cache
+	serviceRoles       []string
+	logger             Logger
+	enforcementMode    EnforcementMode
+	exemptPaths        []string
+	cacheSkew          time.Duration
+	maxCacheTTL        time.Duration
+	negativeCacheTTL   time.Duration
+	serviceTokenClient *serviceTokenClient
+	localValidator     *FernetValidator
 }
 
+// invalidToken is cached in place of a token to negatively cache a token that
+// Keystone rejected, protecting the identity endpoint from repeated lookups
+// of the same bad token.
+type invalidToken struct{}
+
+var errCachedInvalid = errors.New("token is cached as invalid")
+
 // Cache provides the interface for cache implmentations.
 // A simple in-memory cache implementation satisfying the Cache interface
 // is provided by github.com/pmylund/go-cache.
@@ -36,52 +54,197 @@ type Cache interface {
 //Handler returns a new keystone http  middleware.
 //The endpoint should point to a keystone v3 url, e.g http://some.where:5000/v3.
 //The cache is optional and should be set to nil to disable token caching.
-func Handler(h http.Handler, endpoint string, cache Cache) http.Handler {
-	return &authHandler{
+//Additional behavior (a structured Logger, service role enforcement, ...) can
+//be configured by passing Options.
+func Handler(h http.Handler, endpoint string, cache Cache, opts ...Option) http.Handler {
+	handler := &authHandler{
 		handler:          h,
 		identityEndpoint: endpoint,
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 		},
-		userAgent:  "go-keystone-middleware/1.0",
-		tokenCache: cache,
+		userAgent:   "go-keystone-middleware/1.0",
+		tokenCache:  cache,
+		logger:      noopLogger{},
+		maxCacheTTL: 5 * time.Minute,
 	}
+	for _, opt := range opts {
+		opt(handler)
+	}
+	return handler
+}
+
+// HandlerWithServiceRoles returns a keystone http middleware like Handler, but
+// additionally validates an `X-Service-Token` header against Keystone the same
+// way `X-Auth-Token` is validated, populating the `X-Service-*` headers from
+// its token context.
+//
+// If serviceRoles is non-empty, the service token must carry at least one of
+// the listed roles or it is treated as invalid, mirroring the behavior of the
+// reference python keystonemiddleware. A nil or empty serviceRoles accepts any
+// service token that validates successfully.
+func HandlerWithServiceRoles(h http.Handler, endpoint string, cache Cache, serviceRoles []string) http.Handler {
+	return Handler(h, endpoint, cache, WithServiceRoles(serviceRoles))
 }
 
 func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	filterIncomingHeaders(req)
 	req.Header.Set("X-Identity-Status", "Invalid")
-	defer h.handler.ServeHTTP(w, req)
-	authToken := req.Header.Get("X-Auth-Token")
-	if authToken == "" {
+	req.Header.Set("X-Service-Identity-Status", "Invalid")
+
+	authenticated := false
+	if authToken := req.Header.Get("X-Auth-Token"); authToken != "" {
+		context, err := h.resolveToken(authToken)
+		if err != nil {
+			h.logValidationFailure("token", authToken, err)
+		} else {
+			authenticated = true
+			req.Header.Set("X-Identity-Status", "Confirmed")
+			for k, v := range context.Headers() {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+
+	if serviceToken := req.Header.Get("X-Service-Token"); serviceToken != "" {
+		context, err := h.resolveToken(serviceToken)
+		if err != nil {
+			h.logValidationFailure("service token", serviceToken, err)
+		} else if h.serviceRolesAllowed(context) {
+			req.Header.Set("X-Service-Identity-Status", "Confirmed")
+			for k, v := range context.ServiceHeaders() {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+
+	if !authenticated && h.enforce(w, req) {
+		return
+	}
+
+	h.handler.ServeHTTP(w, req)
+}
+
+// logValidationFailure logs a failed token validation at an appropriate
+// level: quietly for a token already known-bad from the negative cache, and
+// as an error for everything else.
+func (h *authHandler) logValidationFailure(kind, tok string, err error) {
+	if err == errCachedInvalid {
+		h.logger.Debug("rejected "+kind+" cached as invalid", "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint)
 		return
 	}
+	h.logger.Error("failed to validate "+kind, "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint, "error", err)
+}
 
-	var context *token
-	//lookup token in cache
+// resolveToken looks up tok in the cache, falling back to validating it
+// against Keystone and populating the cache on success.
+func (h *authHandler) resolveToken(tok string) (*token, error) {
 	if h.tokenCache != nil {
-		if val, ok := h.tokenCache.Get(authToken); ok {
+		if val, ok := h.tokenCache.Get(tok); ok {
+			if _, invalid := val.(invalidToken); invalid {
+				return nil, errCachedInvalid
+			}
+			h.logger.Debug("token cache hit", "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint)
 			cachedToken := val.(token)
-			context = &cachedToken
+			return &cachedToken, nil
 		}
 	}
-	if context == nil {
-		var err error
-		context, err = h.validate(authToken)
-		if err != nil {
-			//ToDo: How to handle logging, printing to stdout isn't the best thing
-			fmt.Println("Failed to validate token. ", err)
-			return
+
+	if h.localValidator != nil {
+		if context, err := h.localValidator.Validate(tok); err == nil {
+			h.logger.Debug("validated token locally via fernet", "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint)
+			h.cacheToken(tok, context)
+			return context, nil
 		}
 	}
-	if h.tokenCache != nil {
-		h.tokenCache.Set(authToken, *context, 5*time.Minute)
+
+	start := time.Now()
+	context, err := h.validate(tok)
+	duration := time.Since(start)
+
+	var statusErr *validationError
+	httpStatus := 0
+	if errors.As(err, &statusErr) {
+		httpStatus = statusErr.statusCode
 	}
 
-	req.Header.Set("X-Identity-Status", "Confirmed")
-	for k, v := range context.Headers() {
-		req.Header.Set(k, v)
+	if err != nil {
+		h.logger.Error("keystone token validation failed", "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint, "http_status", httpStatus, "duration_ms", duration.Milliseconds(), "error", err)
+		if h.tokenCache != nil && h.negativeCacheTTL > 0 && isNegativelyCacheable(httpStatus) {
+			h.tokenCache.Set(tok, invalidToken{}, h.negativeCacheTTL)
+		}
+		return nil, err
 	}
+	h.logger.Debug("keystone token validation succeeded", "token_id_hash", hashToken(tok), "endpoint", h.identityEndpoint, "http_status", httpStatus, "duration_ms", duration.Milliseconds())
+
+	h.cacheToken(tok, context)
+	return context, nil
+}
+
+// cacheToken caches ctx under tok for its computed cacheTTL. A computed TTL
+// of zero or less means ctx is already expired (or within cacheSkew of
+// expiring); it is deliberately not cached; a Set with ttl<=0 would be
+// interpreted by most Cache implementations, including the pmylund/go-cache
+// adapter referenced by Cache's doc comment, as "use the cache's configured
+// default expiration" rather than "expire immediately", which for a cache
+// with no default would cache the token forever.
+func (h *authHandler) cacheToken(tok string, ctx *token) {
+	if h.tokenCache == nil {
+		return
+	}
+	if ttl := h.cacheTTL(ctx); ttl > 0 {
+		h.tokenCache.Set(tok, *ctx, ttl)
+	}
+}
+
+// isNegativelyCacheable reports whether a Keystone validation failure with
+// the given http status is safe to negative-cache, i.e. it reflects the
+// token itself being rejected rather than a transient failure.
+func isNegativelyCacheable(httpStatus int) bool {
+	return httpStatus == http.StatusUnauthorized || httpStatus == http.StatusNotFound
+}
+
+// cacheTTL derives how long ctx should be cached for: the time remaining
+// until ctx.ExpiresAt minus the configured skew, capped at maxCacheTTL. If
+// ExpiresAt is missing or unparsable, maxCacheTTL is used as-is.
+func (h *authHandler) cacheTTL(ctx *token) time.Duration {
+	ttl := h.maxCacheTTL
+	if expiresAt, err := time.Parse(time.RFC3339, ctx.ExpiresAt); err == nil {
+		if remaining := time.Until(expiresAt) - h.cacheSkew; remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl
+}
+
+// hashToken returns a hex-encoded sha256 digest of a token value, suitable
+// for logging as token_id_hash without leaking the token itself.
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// serviceRolesAllowed reports whether ctx satisfies the configured
+// serviceRoles. With no serviceRoles configured, any validated service token
+// is allowed.
+func (h *authHandler) serviceRolesAllowed(ctx *token) bool {
+	if len(h.serviceRoles) == 0 {
+		return true
+	}
+	if ctx.Roles == nil {
+		return false
+	}
+	for _, role := range *ctx.Roles {
+		for _, allowed := range h.serviceRoles {
+			if role.Name == allowed {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type domain struct {
@@ -118,6 +281,7 @@ type token struct {
 		ID   string
 		Name string
 	}
+	AuditIDs *[]string `json:"audit_ids"`
 }
 
 type authResponse struct {
@@ -130,22 +294,35 @@ type authResponse struct {
 }
 
 func (t token) Headers() map[string]string {
+	return t.headersWithPrefix("X-")
+}
+
+// ServiceHeaders returns the same token context as Headers, but keyed under
+// the `X-Service-*` header variants used for the service half of a dual
+// user/service token request.
+func (t token) ServiceHeaders() map[string]string {
+	return t.headersWithPrefix("X-Service-")
+}
+
+func (t token) headersWithPrefix(prefix string) map[string]string {
 	headers := make(map[string]string)
-	headers["X-User-Id"] = t.User.ID
-	headers["X-User-Domain-Id"] = t.User.DomainID
-	headers["X-User-Domain-Name"] = t.User.Domain.Name
+	headers[prefix+"User-Id"] = t.User.ID
+	headers[prefix+"User-Domain-Id"] = t.User.DomainID
+	headers[prefix+"User-Domain-Name"] = t.User.Domain.Name
 
 	if project := t.Project; project != nil {
-		headers["X-Project-Name"] = project.Name
-		headers["X-Project-Id"] = project.ID
-		headers["X-Project-Domain-Name"] = project.Domain.Name
-		headers["X-Project-Domain-Id"] = project.DomainID
+		headers[prefix+"Project-Name"] = project.Name
+		headers[prefix+"Project-Id"] = project.ID
+		if project.Domain != nil {
+			headers[prefix+"Project-Domain-Name"] = project.Domain.Name
+		}
+		headers[prefix+"Project-Domain-Id"] = project.DomainID
 
 	}
 
 	if domain := t.Domain; domain != nil {
-		headers["X-Domain-Id"] = domain.ID
-		headers["X-Domain-Name"] = domain.Name
+		headers[prefix+"Domain-Id"] = domain.ID
+		headers[prefix+"Domain-Name"] = domain.Name
 	}
 
 	if roles := t.Roles; roles != nil {
@@ -153,20 +330,40 @@ func (t token) Headers() map[string]string {
 		for _, role := range *t.Roles {
 			roleNames = append(roleNames, role.Name)
 		}
-		headers["X-Roles"] = strings.Join(roleNames, ",")
+		headers[prefix+"Roles"] = strings.Join(roleNames, ",")
 
 	}
 
 	return headers
 }
 
+// validationError wraps a Keystone validation failure with the http status
+// code it was returned with, so callers can log/branch on it without
+// re-parsing the error message.
+type validationError struct {
+	statusCode int
+	err        error
+}
+
+func (e *validationError) Error() string { return e.err.Error() }
+func (e *validationError) Unwrap() error { return e.err }
+
 func (h *authHandler) validate(token string) (*token, error) {
 
 	req, err := http.NewRequest("GET", h.identityEndpoint+"/auth/tokens?nocatalog", nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-Auth-Token", token)
+
+	authToken := token
+	if h.serviceTokenClient != nil {
+		serviceToken, err := h.serviceTokenClient.Token()
+		if err != nil {
+			return nil, &validationError{err: fmt.Errorf("failed to obtain service token: %w", err)}
+		}
+		authToken = serviceToken
+	}
+	req.Header.Set("X-Auth-Token", authToken)
 	req.Header.Set("X-Subject-Token", token)
 	req.Header.Set("User-Agent", h.userAgent)
 
@@ -177,17 +374,17 @@ func (h *authHandler) validate(token string) (*token, error) {
 	defer r.Body.Close()
 	var resp authResponse
 	if err = json.NewDecoder(r.Body).Decode(&resp); err != nil {
-		return nil, err
+		return nil, &validationError{statusCode: r.StatusCode, err: err}
 	}
 
 	if e := resp.Error; e != nil {
-		return nil, fmt.Errorf("%s : %s", r.Status, e.Message)
+		return nil, &validationError{statusCode: r.StatusCode, err: fmt.Errorf("%s : %s", r.Status, e.Message)}
 	}
 	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", r.Status)
+		return nil, &validationError{statusCode: r.StatusCode, err: fmt.Errorf("%s", r.Status)}
 	}
 	if resp.Token == nil {
-		return nil, errors.New("Response didn't contain token context")
+		return nil, &validationError{statusCode: r.StatusCode, err: errors.New("Response didn't contain token context")}
 	}
 
 	return resp.Token, nil
@@ -0,0 +1,174 @@
+package keystone
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// decodeMsgPack decodes a single MessagePack value from the front of buf,
+// returning the decoded value and how many bytes were consumed. It supports
+// the subset of the format used by Keystone's Fernet token payloads: nil,
+// bool, (u)int, float, str, bin, array and map.
+func decodeMsgPack(buf []byte) (interface{}, int, error) {
+	if len(buf) == 0 {
+		return nil, 0, errors.New("keystone: unexpected end of msgpack data")
+	}
+	b := buf[0]
+
+	switch {
+	case b <= 0x7f: // positive fixint
+		return int64(b), 1, nil
+	case b >= 0xe0: // negative fixint
+		return int64(int8(b)), 1, nil
+	case b&0xf0 == 0x80: // fixmap
+		return decodeMsgPackMap(buf, 1, int(b&0x0f))
+	case b&0xf0 == 0x90: // fixarray
+		return decodeMsgPackArray(buf, 1, int(b&0x0f))
+	case b&0xe0 == 0xa0: // fixstr
+		return decodeMsgPackStr(buf, 1, int(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, 1, nil
+	case 0xc2:
+		return false, 1, nil
+	case 0xc3:
+		return true, 1, nil
+	case 0xc4: // bin8
+		if len(buf) < 2 {
+			return nil, 0, errors.New("keystone: truncated msgpack bin8")
+		}
+		return decodeMsgPackBin(buf, 2, int(buf[1]))
+	case 0xc5: // bin16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack bin16")
+		}
+		return decodeMsgPackBin(buf, 3, int(binary.BigEndian.Uint16(buf[1:3])))
+	case 0xca: // float32
+		if len(buf) < 5 {
+			return nil, 0, errors.New("keystone: truncated msgpack float32")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf[1:5]))), 5, nil
+	case 0xcb: // float64
+		if len(buf) < 9 {
+			return nil, 0, errors.New("keystone: truncated msgpack float64")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf[1:9])), 9, nil
+	case 0xcc: // uint8
+		if len(buf) < 2 {
+			return nil, 0, errors.New("keystone: truncated msgpack uint8")
+		}
+		return int64(buf[1]), 2, nil
+	case 0xcd: // uint16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack uint16")
+		}
+		return int64(binary.BigEndian.Uint16(buf[1:3])), 3, nil
+	case 0xce: // uint32
+		if len(buf) < 5 {
+			return nil, 0, errors.New("keystone: truncated msgpack uint32")
+		}
+		return int64(binary.BigEndian.Uint32(buf[1:5])), 5, nil
+	case 0xcf: // uint64
+		if len(buf) < 9 {
+			return nil, 0, errors.New("keystone: truncated msgpack uint64")
+		}
+		return int64(binary.BigEndian.Uint64(buf[1:9])), 9, nil
+	case 0xd0: // int8
+		if len(buf) < 2 {
+			return nil, 0, errors.New("keystone: truncated msgpack int8")
+		}
+		return int64(int8(buf[1])), 2, nil
+	case 0xd1: // int16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack int16")
+		}
+		return int64(int16(binary.BigEndian.Uint16(buf[1:3]))), 3, nil
+	case 0xd2: // int32
+		if len(buf) < 5 {
+			return nil, 0, errors.New("keystone: truncated msgpack int32")
+		}
+		return int64(int32(binary.BigEndian.Uint32(buf[1:5]))), 5, nil
+	case 0xd3: // int64
+		if len(buf) < 9 {
+			return nil, 0, errors.New("keystone: truncated msgpack int64")
+		}
+		return int64(binary.BigEndian.Uint64(buf[1:9])), 9, nil
+	case 0xd9: // str8
+		if len(buf) < 2 {
+			return nil, 0, errors.New("keystone: truncated msgpack str8")
+		}
+		return decodeMsgPackStr(buf, 2, int(buf[1]))
+	case 0xda: // str16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack str16")
+		}
+		return decodeMsgPackStr(buf, 3, int(binary.BigEndian.Uint16(buf[1:3])))
+	case 0xdc: // array16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack array16")
+		}
+		return decodeMsgPackArray(buf, 3, int(binary.BigEndian.Uint16(buf[1:3])))
+	case 0xde: // map16
+		if len(buf) < 3 {
+			return nil, 0, errors.New("keystone: truncated msgpack map16")
+		}
+		return decodeMsgPackMap(buf, 3, int(binary.BigEndian.Uint16(buf[1:3])))
+	}
+
+	return nil, 0, fmt.Errorf("keystone: unsupported msgpack type byte 0x%x", b)
+}
+
+func decodeMsgPackStr(buf []byte, offset, n int) (interface{}, int, error) {
+	if len(buf) < offset+n {
+		return nil, 0, errors.New("keystone: truncated msgpack str")
+	}
+	return string(buf[offset : offset+n]), offset + n, nil
+}
+
+func decodeMsgPackBin(buf []byte, offset, n int) (interface{}, int, error) {
+	if len(buf) < offset+n {
+		return nil, 0, errors.New("keystone: truncated msgpack bin")
+	}
+	out := make([]byte, n)
+	copy(out, buf[offset:offset+n])
+	return out, offset + n, nil
+}
+
+func decodeMsgPackArray(buf []byte, offset, n int) (interface{}, int, error) {
+	items := make([]interface{}, 0, n)
+	pos := offset
+	for i := 0; i < n; i++ {
+		v, consumed, err := decodeMsgPack(buf[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		items = append(items, v)
+		pos += consumed
+	}
+	return items, pos, nil
+}
+
+func decodeMsgPackMap(buf []byte, offset, n int) (interface{}, int, error) {
+	out := make(map[interface{}]interface{}, n)
+	pos := offset
+	for i := 0; i < n; i++ {
+		k, consumed, err := decodeMsgPack(buf[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += consumed
+
+		v, consumed, err := decodeMsgPack(buf[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += consumed
+
+		out[k] = v
+	}
+	return out, pos, nil
+}
@@ -0,0 +1,54 @@
+package keystone
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeMsgPack(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		want     interface{}
+		consumed int
+	}{
+		{"positive fixint", []byte{0x05}, int64(5), 1},
+		{"negative fixint", []byte{0xff}, int64(-1), 1},
+		{"nil", []byte{0xc0}, nil, 1},
+		{"false", []byte{0xc2}, false, 1},
+		{"true", []byte{0xc3}, true, 1},
+		{"fixstr", []byte{0xa2, 'h', 'i'}, "hi", 3},
+		{"bin8", []byte{0xc4, 0x03, 0x01, 0x02, 0x03}, []byte{0x01, 0x02, 0x03}, 5},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, int64(256), 3},
+		{"int64", []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 42}, int64(42), 9},
+		{"fixarray", []byte{0x92, 0x01, 0xa1, 'x'}, []interface{}{int64(1), "x"}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, consumed, err := decodeMsgPack(tt.input)
+			if err != nil {
+				t.Fatalf("decodeMsgPack(%v) returned error: %v", tt.input, err)
+			}
+			if consumed != tt.consumed {
+				t.Errorf("consumed = %d, want %d", consumed, tt.consumed)
+			}
+			if b, ok := got.([]byte); ok {
+				if !bytes.Equal(b, tt.want.([]byte)) {
+					t.Errorf("decoded = %v, want %v", b, tt.want)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMsgPackTruncated(t *testing.T) {
+	if _, _, err := decodeMsgPack([]byte{0xc4, 0x05, 0x01}); err == nil {
+		t.Fatal("decodeMsgPack succeeded on truncated bin8, want error")
+	}
+}